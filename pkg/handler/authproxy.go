@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog"
+
+	"github.com/IBM/management-ingress-operator/pkg/utils"
+)
+
+const (
+	oauthProxyPort         = int32(4180)
+	defaultOAuthProxyImage = "quay.io/oauth2-proxy/oauth2-proxy:latest"
+
+	// oidcClientSecretKey is the key under which CreateOrUpdateDeployment's
+	// platform-oidc-credentials secret stores the OIDC client secret.
+	oidcClientSecretKey = "WLP_CLIENT_SECRET"
+
+	// oauthProxySecretName is the name of the copy of platform-oidc-credentials
+	// mirrorOIDCClientSecret keeps in the Deployment's own namespace.
+	oauthProxySecretName = AppName + "-oauth2-proxy-credentials"
+
+	// oauthProxyCookieSecretName is the Secret ensureOAuthProxyCookieSecret
+	// generates, once per Deployment, to hold the oauth2-proxy cookie secret.
+	oauthProxyCookieSecretName = AppName + "-oauth2-proxy-cookie-secret"
+
+	// oauthProxyCookieSecretKey is the key under which that Secret stores the
+	// cookie secret.
+	oauthProxyCookieSecretKey = "cookie-secret"
+)
+
+// AuthProxySpec configures the optional oauth2-proxy sidecar that can
+// terminate OIDC authentication in front of the management ingress
+// container, for clusters where impersonation is disallowed. It mirrors
+// ManagementIngress.Spec.AuthProxy.
+type AuthProxySpec struct {
+	Enabled   bool
+	Image     string
+	Resources *core.ResourceRequirements
+}
+
+// newOAuthProxyContainer builds the oauth2-proxy sidecar that terminates
+// OIDC auth using the same platform-auth-idp/platform-oidc-credentials
+// material CreateOrUpdateDeployment already reads for the main container,
+// shares its TLS secret volume, and forwards authenticated traffic to the
+// main container on 127.0.0.1:8080.
+//
+// Neither secret oauth2-proxy needs is passed on the command line: the
+// client secret is read from OAUTH2_PROXY_CLIENT_SECRET and the mandatory
+// cookie-signing secret from OAUTH2_PROXY_COOKIE_SECRET, both sourced via a
+// SecretKeyRef so they never appear in the Pod spec (Args and plain env
+// Values are both visible via `kubectl get pod -o yaml`; a SecretKeyRef is
+// not).
+func newOAuthProxyContainer(authProxy *AuthProxySpec, oidcURL, clientID, clientSecretName, cookieSecretName string) core.Container {
+	image := authProxy.Image
+	if image == "" {
+		image = defaultOAuthProxyImage
+	}
+
+	resources := authProxy.Resources
+	if resources == nil {
+		resources = &core.ResourceRequirements{
+			Limits: core.ResourceList{core.ResourceMemory: defaultMemory},
+			Requests: core.ResourceList{
+				core.ResourceMemory: defaultMemory,
+				core.ResourceCPU:    defaultCpuRequest,
+			},
+		}
+	}
+
+	probe := &core.Probe{
+		TimeoutSeconds:      1,
+		InitialDelaySeconds: 10,
+		PeriodSeconds:       10,
+		Handler: core.Handler{
+			HTTPGet: &core.HTTPGetAction{
+				Path:   "/ping",
+				Port:   intstr.IntOrString{Type: intstr.Int, IntVal: oauthProxyPort},
+				Scheme: core.URISchemeHTTPS,
+			},
+		},
+	}
+	livenessProbe := *probe
+	livenessProbe.FailureThreshold = 10
+
+	return core.Container{
+		Name:            "oauth2-proxy",
+		Image:           image,
+		ImagePullPolicy: core.PullIfNotPresent,
+		Resources:       *resources,
+		Args: []string{
+			"--https-address=0.0.0.0:" + strconv.Itoa(int(oauthProxyPort)),
+			"--upstream=http://127.0.0.1:8080",
+			"--provider=oidc",
+			"--oidc-issuer-url=" + oidcURL,
+			"--client-id=" + clientID,
+			"--tls-cert-file=/var/run/secrets/tls/tls.crt",
+			"--tls-key-file=/var/run/secrets/tls/tls.key",
+			"--email-domain=*",
+		},
+		Env: []core.EnvVar{
+			{
+				Name: "OAUTH2_PROXY_CLIENT_SECRET",
+				ValueFrom: &core.EnvVarSource{
+					SecretKeyRef: &core.SecretKeySelector{
+						LocalObjectReference: core.LocalObjectReference{Name: clientSecretName},
+						Key:                  oidcClientSecretKey,
+					},
+				},
+			},
+			{
+				Name: "OAUTH2_PROXY_COOKIE_SECRET",
+				ValueFrom: &core.EnvVarSource{
+					SecretKeyRef: &core.SecretKeySelector{
+						LocalObjectReference: core.LocalObjectReference{Name: cookieSecretName},
+						Key:                  oauthProxyCookieSecretKey,
+					},
+				},
+			},
+		},
+		Ports: []core.ContainerPort{
+			{Name: "oauth-proxy", ContainerPort: oauthProxyPort, Protocol: core.ProtocolTCP},
+		},
+		VolumeMounts: []core.VolumeMount{
+			{Name: "tls-secret", MountPath: "/var/run/secrets/tls"},
+		},
+		SecurityContext: &core.SecurityContext{
+			Privileged:               utils.GetBool(false),
+			AllowPrivilegeEscalation: utils.GetBool(false),
+		},
+		LivenessProbe:  &livenessProbe,
+		ReadinessProbe: probe,
+	}
+}
+
+// mirrorOIDCClientSecret returns the name of a Secret, in the Deployment's
+// own namespace, holding the OIDC client secret - so the oauth2-proxy
+// sidecar's SecretKeyRef can resolve it. A SecretKeyRef only resolves
+// within the Pod's own namespace, but platform-oidc-credentials normally
+// lives in Spec.IAMNamespace, which exists precisely because it can differ
+// from the namespace the ManagementIngress (and its Deployment) run in.
+// When the two namespaces match, source is used directly and nothing is
+// copied.
+func (ingressRequest *IngressRequest) mirrorOIDCClientSecret(source *core.Secret) (string, error) {
+	if ingressRequest.managementIngress.Spec.IAMNamespace == ingressRequest.managementIngress.Namespace {
+		return source.Name, nil
+	}
+
+	mirrored := &core.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: core.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      oauthProxySecretName,
+			Namespace: ingressRequest.managementIngress.Namespace,
+		},
+		Data: map[string][]byte{
+			oidcClientSecretKey: source.Data[oidcClientSecretKey],
+		},
+	}
+	utils.AddOwnerRefToObject(mirrored, utils.AsOwner(ingressRequest.managementIngress))
+
+	klog.Infof("Mirroring platform-oidc-credentials into %q for the oauth2-proxy sidecar of %q.", oauthProxySecretName, ingressRequest.managementIngress.Name)
+	if err := ingressRequest.Create(mirrored); err != nil {
+		if !errors.IsAlreadyExists(err) {
+			return "", fmt.Errorf("Failure creating mirrored oauth2-proxy secret %q: %v", oauthProxySecretName, err)
+		}
+
+		current := &core.Secret{}
+		if err := ingressRequest.Get(oauthProxySecretName, current); err != nil {
+			return "", fmt.Errorf("Failure getting mirrored oauth2-proxy secret %q: %v", oauthProxySecretName, err)
+		}
+		mirrored.ResourceVersion = current.ResourceVersion
+		if err := ingressRequest.Update(mirrored); err != nil {
+			return "", fmt.Errorf("Failure updating mirrored oauth2-proxy secret %q: %v", oauthProxySecretName, err)
+		}
+	}
+
+	return oauthProxySecretName, nil
+}
+
+// ensureOAuthProxyCookieSecret returns the name of a Secret, in the
+// Deployment's own namespace, holding the random key oauth2-proxy signs its
+// session cookies with. oauth2-proxy treats this as mandatory config and
+// refuses to start without one. Unlike the client secret, there's no
+// upstream material to mirror here, so the key is generated once and reused
+// on every later reconcile - regenerating it on each reconcile would log
+// every existing session out on every resync.
+func (ingressRequest *IngressRequest) ensureOAuthProxyCookieSecret() (string, error) {
+	current := &core.Secret{}
+	if err := ingressRequest.Get(oauthProxyCookieSecretName, current); err == nil {
+		return oauthProxyCookieSecretName, nil
+	} else if !errors.IsNotFound(err) {
+		return "", fmt.Errorf("Failure getting oauth2-proxy cookie secret %q: %v", oauthProxyCookieSecretName, err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("Failure generating oauth2-proxy cookie secret: %v", err)
+	}
+
+	secret := &core.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: core.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      oauthProxyCookieSecretName,
+			Namespace: ingressRequest.managementIngress.Namespace,
+		},
+		Data: map[string][]byte{
+			oauthProxyCookieSecretKey: []byte(base64.StdEncoding.EncodeToString(key)),
+		},
+	}
+	utils.AddOwnerRefToObject(secret, utils.AsOwner(ingressRequest.managementIngress))
+
+	klog.Infof("Generating oauth2-proxy cookie secret %q for %q.", oauthProxyCookieSecretName, ingressRequest.managementIngress.Name)
+	if err := ingressRequest.Create(secret); err != nil && !errors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("Failure creating oauth2-proxy cookie secret %q: %v", oauthProxyCookieSecretName, err)
+	}
+
+	return oauthProxyCookieSecretName, nil
+}
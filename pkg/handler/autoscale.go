@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"fmt"
+	"reflect"
+
+	autoscaling "k8s.io/api/autoscaling/v2"
+	policy "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog"
+
+	"github.com/IBM/management-ingress-operator/pkg/utils"
+)
+
+// defaultTargetCPUUtilization is used when Spec.Autoscaling.TargetCPUUtilizationPercentage is unset.
+const defaultTargetCPUUtilization = int32(80)
+
+// NewHorizontalPodAutoscaler stubs an HPA targeting the management-ingress
+// Deployment, scaling on CPU utilization and any custom metrics supplied in
+// the CR spec.
+func NewHorizontalPodAutoscaler(name, namespace string, autoscalingSpec *AutoscalingSpec) *autoscaling.HorizontalPodAutoscaler {
+	targetCPU := defaultTargetCPUUtilization
+	if autoscalingSpec.TargetCPUUtilizationPercentage != nil {
+		targetCPU = *autoscalingSpec.TargetCPUUtilizationPercentage
+	}
+
+	metrics := []autoscaling.MetricSpec{
+		{
+			Type: autoscaling.ResourceMetricSourceType,
+			Resource: &autoscaling.ResourceMetricSource{
+				Name: "cpu",
+				Target: autoscaling.MetricTarget{
+					Type:               autoscaling.UtilizationMetricType,
+					AverageUtilization: &targetCPU,
+				},
+			},
+		},
+	}
+	metrics = append(metrics, autoscalingSpec.Metrics...)
+
+	return &autoscaling.HorizontalPodAutoscaler{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "HorizontalPodAutoscaler",
+			APIVersion: autoscaling.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: autoscaling.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscaling.CrossVersionObjectReference{
+				Kind:       "Deployment",
+				Name:       name,
+				APIVersion: "apps/v1",
+			},
+			MinReplicas: &autoscalingSpec.MinReplicas,
+			MaxReplicas: autoscalingSpec.MaxReplicas,
+			Metrics:     metrics,
+		},
+	}
+}
+
+// NewPodDisruptionBudget stubs a PDB protecting the management-ingress
+// Deployment, keeping at least MinReplicas pods available across voluntary
+// disruptions while the HPA is free to scale above that floor.
+func NewPodDisruptionBudget(name, namespace string, autoscalingSpec *AutoscalingSpec) *policy.PodDisruptionBudget {
+	labels := map[string]string{
+		"component": AppName,
+		"app":       AppName,
+	}
+	minAvailable := intstr.FromInt(int(autoscalingSpec.MinReplicas))
+
+	return &policy.PodDisruptionBudget{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PodDisruptionBudget",
+			APIVersion: policy.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: policy.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+		},
+	}
+}
+
+// CreateOrUpdateAutoscaler reconciles the HPA and PDB for the management-ingress
+// Deployment when Spec.Autoscaling is set. It is a no-op when autoscaling is
+// not configured, leaving the single-replica Deployment from NewDeployment alone.
+func (ingressRequest *IngressRequest) CreateOrUpdateAutoscaler() error {
+	autoscalingSpec := ingressRequest.managementIngress.Spec.Autoscaling
+	if autoscalingSpec == nil {
+		return nil
+	}
+
+	hpa := NewHorizontalPodAutoscaler(AppName, ingressRequest.managementIngress.Namespace, autoscalingSpec)
+	utils.AddOwnerRefToObject(hpa, utils.AsOwner(ingressRequest.managementIngress))
+
+	if err := ingressRequest.createOrUpdateHPA(hpa); err != nil {
+		return err
+	}
+
+	pdb := NewPodDisruptionBudget(AppName, ingressRequest.managementIngress.Namespace, autoscalingSpec)
+	utils.AddOwnerRefToObject(pdb, utils.AsOwner(ingressRequest.managementIngress))
+
+	return ingressRequest.createOrUpdatePDB(pdb)
+}
+
+// createOrUpdateHPA diffs hpa's Spec against whatever's already on the
+// cluster before calling Update, so a no-op resync doesn't bump the HPA's
+// resourceVersion.
+func (ingressRequest *IngressRequest) createOrUpdateHPA(hpa *autoscaling.HorizontalPodAutoscaler) error {
+	klog.Infof("Creating or Updating HorizontalPodAutoscaler: %s for %q.", AppName, ingressRequest.managementIngress.Name)
+	err := ingressRequest.Create(hpa)
+	if err == nil {
+		return nil
+	}
+	if !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("Failure creating HorizontalPodAutoscaler %q: %v", AppName, err)
+	}
+
+	current := &autoscaling.HorizontalPodAutoscaler{}
+	if err := ingressRequest.Get(AppName, current); err != nil {
+		return fmt.Errorf("Failure getting HorizontalPodAutoscaler %q for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+	}
+	if reflect.DeepEqual(current.Spec, hpa.Spec) {
+		return nil
+	}
+
+	hpa.ResourceVersion = current.ResourceVersion
+	if err := ingressRequest.Update(hpa); err != nil {
+		return fmt.Errorf("Failure updating HorizontalPodAutoscaler %q for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+	}
+	return nil
+}
+
+// createOrUpdatePDB diffs pdb's Spec against whatever's already on the
+// cluster before calling Update, so a no-op resync doesn't bump the PDB's
+// resourceVersion.
+func (ingressRequest *IngressRequest) createOrUpdatePDB(pdb *policy.PodDisruptionBudget) error {
+	klog.Infof("Creating or Updating PodDisruptionBudget: %s for %q.", AppName, ingressRequest.managementIngress.Name)
+	err := ingressRequest.Create(pdb)
+	if err == nil {
+		return nil
+	}
+	if !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("Failure creating PodDisruptionBudget %q: %v", AppName, err)
+	}
+
+	current := &policy.PodDisruptionBudget{}
+	if err := ingressRequest.Get(AppName, current); err != nil {
+		return fmt.Errorf("Failure getting PodDisruptionBudget %q for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+	}
+	if reflect.DeepEqual(current.Spec, pdb.Spec) {
+		return nil
+	}
+
+	pdb.ResourceVersion = current.ResourceVersion
+	if err := ingressRequest.Update(pdb); err != nil {
+		return fmt.Errorf("Failure updating PodDisruptionBudget %q for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+	}
+	return nil
+}
+
+// AutoscalingSpec configures the optional HPA/PDB subsystem for the
+// management-ingress Deployment. It mirrors ManagementIngress.Spec.Autoscaling.
+type AutoscalingSpec struct {
+	MinReplicas                    int32
+	MaxReplicas                    int32
+	TargetCPUUtilizationPercentage *int32
+	Metrics                        []autoscaling.MetricSpec
+}
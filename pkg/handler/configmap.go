@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// nginxConfigMapName is the ConfigMap newPodSpec's --configmap flag
+	// points the container at for its nginx directives.
+	nginxConfigMapName = "management-ingress"
+
+	// grpcPassKey/http2Key are the directive keys CreateOrUpdateConfigMap
+	// sets so nginx proxies to a gRPC/HTTP2 upstream when BackendProtocol
+	// calls for it. Any other keys already on the ConfigMap are left alone.
+	grpcPassKey = "grpc_pass"
+	http2Key    = "http2"
+)
+
+// setGRPCDirectives sets or clears the grpc_pass/http2 directive keys on cm
+// according to backendProtocol, leaving every other key on cm untouched.
+func setGRPCDirectives(cm *core.ConfigMap, backendProtocol BackendProtocol) {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	if isGRPCBackend(backendProtocol) {
+		cm.Data[grpcPassKey] = fmt.Sprintf("grpc://127.0.0.1:%d", grpcPort)
+		cm.Data[http2Key] = "on"
+		return
+	}
+	delete(cm.Data, grpcPassKey)
+	delete(cm.Data, http2Key)
+}
+
+// CreateOrUpdateConfigMap reconciles the grpc_pass/http2 directive keys on
+// the "management-ingress" ConfigMap the container reads via --configmap,
+// leaving any other keys already on the ConfigMap untouched. Unlike the
+// Deployment/Service/autoscaler handlers this doesn't own the whole object
+// - the ConfigMap may carry unrelated nginx directives this operator
+// doesn't model - so it patches in place rather than replacing wholesale.
+// It diffs grpc_pass/http2 against their previous values before calling
+// Update, so a no-op resync doesn't bump the ConfigMap's resourceVersion.
+func (ingressRequest *IngressRequest) CreateOrUpdateConfigMap(backendProtocol BackendProtocol) error {
+	cm := &core.ConfigMap{}
+	err := ingressRequest.Get(nginxConfigMapName, cm)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("Failure getting ConfigMap %q for %q: %v", nginxConfigMapName, ingressRequest.managementIngress.Name, err)
+		}
+
+		cm = &core.ConfigMap{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "ConfigMap",
+				APIVersion: core.SchemeGroupVersion.String(),
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      nginxConfigMapName,
+				Namespace: ingressRequest.managementIngress.Namespace,
+			},
+		}
+		setGRPCDirectives(cm, backendProtocol)
+
+		klog.Infof("Creating ConfigMap: %s for %q.", nginxConfigMapName, ingressRequest.managementIngress.Name)
+		if err := ingressRequest.Create(cm); err != nil {
+			return fmt.Errorf("Failure creating ConfigMap %q: %v", nginxConfigMapName, err)
+		}
+		return nil
+	}
+
+	grpcPass, http2 := cm.Data[grpcPassKey], cm.Data[http2Key]
+	setGRPCDirectives(cm, backendProtocol)
+	if cm.Data[grpcPassKey] == grpcPass && cm.Data[http2Key] == http2 {
+		return nil
+	}
+
+	klog.Infof("Updating ConfigMap: %s for %q.", nginxConfigMapName, ingressRequest.managementIngress.Name)
+	if err := ingressRequest.Update(cm); err != nil {
+		return fmt.Errorf("Failure updating ConfigMap %q for %q: %v", nginxConfigMapName, ingressRequest.managementIngress.Name, err)
+	}
+	return nil
+}
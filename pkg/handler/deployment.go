@@ -1,8 +1,12 @@
 package handler
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	apps "k8s.io/api/apps/v1"
@@ -13,14 +17,60 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 
+	"github.com/IBM/management-ingress-operator/pkg/metrics"
 	"github.com/IBM/management-ingress-operator/pkg/utils"
 )
 
 const (
 	httpsPort = int32(8443)
 	httpPort  = int32(8080)
+	grpcPort  = int32(8444)
+
+	// impersonationEnabled and fipsEnabled are not yet exposed on the CR
+	// spec, so the container env and the feature_enabled metric both read
+	// from these single constants rather than hardcoding "false" twice.
+	impersonationEnabled = false
+	fipsEnabled          = false
+
+	// metricsScanInterval is how often the background goroutine re-scans
+	// GetDeploymentList to keep the replica gauges fresh between reconciles.
+	metricsScanInterval = 1 * time.Minute
+)
+
+var startMetricsScanOnce sync.Once
+
+// startMetricsScan launches the periodic replica-gauge scan exactly once
+// per operator process. Collector registration itself happens in
+// pkg/metrics's init(), at process startup; this only needs a live
+// IngressRequest to list Deployments with, so it starts on first use rather
+// than waiting for a dedicated manager-startup hook in this tree.
+func (ingressRequest *IngressRequest) startMetricsScan(selector map[string]string) {
+	startMetricsScanOnce.Do(func() {
+		go metrics.StartPeriodicScan(ingressRequest, selector, metricsScanInterval, nil)
+	})
+}
+
+// BackendProtocol mirrors nginx's "backend-protocol" annotation, letting an
+// ManagementIngress declare what protocol the upstream container actually
+// speaks. It drives the container's extra listener port, --grpc-port flag,
+// BACKEND_PROTOCOL env var, CreateOrUpdateService's matching Service port,
+// and CreateOrUpdateConfigMap's grpc_pass/http2 nginx directives.
+type BackendProtocol string
+
+const (
+	BackendProtocolHTTP  BackendProtocol = "HTTP"
+	BackendProtocolHTTPS BackendProtocol = "HTTPS"
+	BackendProtocolGRPC  BackendProtocol = "GRPC"
+	BackendProtocolGRPCS BackendProtocol = "GRPCS"
+	BackendProtocolH2C   BackendProtocol = "H2C"
 )
 
+// isGRPCBackend reports whether the backend protocol requires the extra
+// gRPC/HTTP2 listener port on the container and Service.
+func isGRPCBackend(protocol BackendProtocol) bool {
+	return protocol == BackendProtocolGRPC || protocol == BackendProtocolGRPCS || protocol == BackendProtocolH2C
+}
+
 //NewDeployment stubs an instance of a deployment
 func NewDeployment(name string, namespace string, podSpec core.PodSpec) *apps.Deployment {
 	labels := map[string]string{
@@ -55,7 +105,7 @@ func NewDeployment(name string, namespace string, podSpec core.PodSpec) *apps.De
 	}
 }
 
-func newPodSpec(imageRepo string, resources *core.ResourceRequirements, nodeSelector map[string]string, tolerations []core.Toleration, allowedHostHeader string, wlpClientID string, oidcURL string) core.PodSpec {
+func newPodSpec(imageRepo string, resources *core.ResourceRequirements, nodeSelector map[string]string, tolerations []core.Toleration, allowedHostHeader string, wlpClientID string, oidcCredentialSecretName string, oidcURL string, backendProtocol BackendProtocol, authProxy *AuthProxySpec, oauthCookieSecretName string) core.PodSpec {
 	if resources == nil {
 		resources = &core.ResourceRequirements{
 			Limits: core.ResourceList{core.ResourceMemory: defaultMemory},
@@ -86,6 +136,14 @@ func newPodSpec(imageRepo string, resources *core.ResourceRequirements, nodeSele
 		},
 	}
 
+	if isGRPCBackend(backendProtocol) {
+		container.Ports = append(container.Ports, core.ContainerPort{
+			Name:          "grpc",
+			ContainerPort: grpcPort,
+			Protocol:      core.ProtocolTCP,
+		})
+	}
+
 	container.Command = []string{
 		"/icp-management-ingress",
 		"--default-ssl-certificate=$(POD_NAMESPACE)/icp-management-ingress-tls-secret",
@@ -94,18 +152,22 @@ func newPodSpec(imageRepo string, resources *core.ResourceRequirements, nodeSele
 		"--https-port=8443",
 	}
 
+	if isGRPCBackend(backendProtocol) {
+		container.Command = append(container.Command, fmt.Sprintf("--grpc-port=%d", grpcPort))
+	}
+
 	container.Env = []core.EnvVar{
-		{Name: "ENABLE_IMPERSONATION", Value: "false"},
+		{Name: "ENABLE_IMPERSONATION", Value: strconv.FormatBool(impersonationEnabled)},
 		{Name: "APISERVER_SECURE_PORT", Value: "6443"},
 		{Name: "CLUSTER_DOMAIN", Value: "mycluster.cp"},
 		{Name: "HOST_HEADERS_CHECK_ENABLED", Value: strconv.FormatBool(len(allowedHostHeader) > 0)},
 		{Name: "ALLOWED_HOST_HEADERS", Value: allowedHostHeader},
 		{Name: "OIDC_ISSUER_URL", Value: oidcURL},
 		{Name: "WLP_CLIENT_ID", Value: wlpClientID},
-		{Name: "POD_NAME", ValueFrom: &core.EnvVarSource{FieldRef: &core.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.name"}}},
-		{Name: "POD_NAMESPACE", ValueFrom: &core.EnvVarSource{FieldRef: &core.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.namespace"}}},
-		{Name: "FIPS_ENABLED", Value: "false"},
+		{Name: "FIPS_ENABLED", Value: strconv.FormatBool(fipsEnabled)},
+		{Name: "BACKEND_PROTOCOL", Value: string(backendProtocol)},
 	}
+	container.Env = append(container.Env, DownwardAPIEnvVars()...)
 
 	container.SecurityContext = &core.SecurityContext{
 		Privileged:               utils.GetBool(false),
@@ -159,8 +221,13 @@ func newPodSpec(imageRepo string, resources *core.ResourceRequirements, nodeSele
 		},
 	)
 
+	containers := []core.Container{container}
+	if authProxy != nil && authProxy.Enabled {
+		containers = append(containers, newOAuthProxyContainer(authProxy, oidcURL, wlpClientID, oidcCredentialSecretName, oauthCookieSecretName))
+	}
+
 	podSpec := core.PodSpec{
-		Containers:         []core.Container{container},
+		Containers:         containers,
 		ServiceAccountName: ServiceAccountName,
 		NodeSelector:       nodeSelector,
 		Tolerations:        tolerations,
@@ -185,7 +252,24 @@ func newPodSpec(imageRepo string, resources *core.ResourceRequirements, nodeSele
 	return podSpec
 }
 
-func (ingressRequest *IngressRequest) CreateOrUpdateDeployment() error {
+// CreateOrUpdateDeployment reconciles the management-ingress Deployment (and
+// its Service/autoscaler) and, after creating or updating the Deployment,
+// blocks until the rollout is ready, RolloutTimeout elapses or ctx is
+// cancelled; an existing Deployment that needs no change is not waited on.
+// The caller - a controller-runtime Reconcile method in the full
+// operator, not present in this checkout - should pass the Reconcile
+// context so a SIGTERM or a bounded-worker timeout can interrupt a stuck
+// wait instead of tying up a reconcile worker until RolloutTimeout elapses.
+func (ingressRequest *IngressRequest) CreateOrUpdateDeployment(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		metrics.ReconcileTotal.WithLabelValues(result).Inc()
+		metrics.ReconcileDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
 
 	authConfigmap := &core.ConfigMap{}
 	if err := ingressRequest.GetWithNamespace(ingressRequest.managementIngress.Spec.IAMNamespace, "platform-auth-idp", authConfigmap); err != nil {
@@ -199,6 +283,26 @@ func (ingressRequest *IngressRequest) CreateOrUpdateDeployment() error {
 	oidcURL := authConfigmap.Data["OIDC_ISSUER_URL"]
 	oauthClientID := string(oidcCredentialSecret.Data["WLP_CLIENT_ID"])
 
+	backendProtocol := BackendProtocol(ingressRequest.managementIngress.Spec.BackendProtocol)
+	if backendProtocol == "" {
+		backendProtocol = BackendProtocolHTTP
+	}
+
+	authProxy := ingressRequest.managementIngress.Spec.AuthProxy
+	oidcCredentialSecretName := oidcCredentialSecret.Name
+	var oauthCookieSecretName string
+	if authProxy != nil && authProxy.Enabled {
+		oidcCredentialSecretName, err = ingressRequest.mirrorOIDCClientSecret(oidcCredentialSecret)
+		if err != nil {
+			return fmt.Errorf("Failure mirroring platform-oidc-credentials for %q: %v", ingressRequest.managementIngress.Name, err)
+		}
+
+		oauthCookieSecretName, err = ingressRequest.ensureOAuthProxyCookieSecret()
+		if err != nil {
+			return fmt.Errorf("Failure ensuring oauth2-proxy cookie secret for %q: %v", ingressRequest.managementIngress.Name, err)
+		}
+	}
+
 	podSpec := newPodSpec(
 		ingressRequest.managementIngress.Spec.ImageRepo,
 		ingressRequest.managementIngress.Spec.Resources,
@@ -206,7 +310,11 @@ func (ingressRequest *IngressRequest) CreateOrUpdateDeployment() error {
 		ingressRequest.managementIngress.Spec.Tolerations,
 		ingressRequest.managementIngress.Spec.AllowedHostHeader,
 		oauthClientID,
+		oidcCredentialSecretName,
 		oidcURL,
+		backendProtocol,
+		authProxy,
+		oauthCookieSecretName,
 	)
 
 	ds := NewDeployment(
@@ -216,10 +324,27 @@ func (ingressRequest *IngressRequest) CreateOrUpdateDeployment() error {
 
 	utils.AddOwnerRefToObject(ds, utils.AsOwner(ingressRequest.managementIngress))
 
+	podInfo := NewPodInfo(nil)
+	klog.Infof("Reconciling Deployment %s for %q from operator pod %s/%s.", AppName, ingressRequest.managementIngress.Name, podInfo.Namespace, podInfo.Name)
+
+	ingressRequest.startMetricsScan(map[string]string{"component": AppName, "app": AppName})
+	metrics.ObserveFeatureFlags(impersonationEnabled, fipsEnabled, len(ingressRequest.managementIngress.Spec.AllowedHostHeader) > 0, oidcURL != "")
+
+	// The HPA has to exist before we wait for the rollout below: when
+	// Spec.Autoscaling.MinReplicas > 1, waitForDeploymentReady blocks until
+	// ReadyReplicas reaches that floor, which only happens once the HPA
+	// scales the Deployment up from its implicit 1-replica default. Creating
+	// the HPA/PDB after the wait would deadlock the first reconcile for
+	// RolloutTimeout.
+	if err = ingressRequest.CreateOrUpdateAutoscaler(); err != nil {
+		return err
+	}
+
 	klog.Infof("Creating or Updating Deployment: %s for %q.", AppName, ingressRequest.managementIngress.Name)
-	err := ingressRequest.Create(ds)
+	err = ingressRequest.Create(ds)
 	if err != nil {
 		if !errors.IsAlreadyExists(err) {
+			metrics.EventTotal.WithLabelValues("create", "failure").Inc()
 			ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Warning", "UpdatedDeployment", "Failure creating deployment %q: %v", AppName, err)
 			return fmt.Errorf("Failure creating Deployment: %v", err)
 		}
@@ -231,23 +356,55 @@ func (ingressRequest *IngressRequest) CreateOrUpdateDeployment() error {
 
 		desired, different := utils.IsDeploymentDifferent(current, ds)
 		if !different {
-			return nil
-		}
+			ds = current
+		} else {
+			klog.Infof("There is change from Deployment %s. Try to update it.", podSpec)
+			err = ingressRequest.Update(desired)
+			if err != nil {
+				metrics.EventTotal.WithLabelValues("update", "failure").Inc()
+				ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Warning", "UpdatedDeployment", "Failure updating deployment %q: %v", AppName, err)
+				return fmt.Errorf("Failure updating %q Deployment for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+			}
+			podInfo = NewPodInfo(desired)
+			ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Normal", "UpdatedDeployment", "Successfully updated deployment %q (observed by operator pod %s/%s)", AppName, podInfo.Namespace, podInfo.Name)
 
-		klog.Infof("There is change from Deployment %s. Try to update it.", podSpec)
-		err = ingressRequest.Update(desired)
-		if err != nil {
-			ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Warning", "UpdatedDeployment", "Failure updating deployment %q: %v", AppName, err)
-			return fmt.Errorf("Failure updating %q Deployment for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+			if err = ingressRequest.waitForDeploymentReady(ctx, desired, podInfo); err != nil {
+				return fmt.Errorf("Failure waiting for %q Deployment to roll out for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+			}
+			ds = desired
 		}
-		ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Normal", "UpdatedDeployment", "Successfully updated deployment %q", AppName)
 	} else {
-		ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Normal", "CreatedDeployment", "Successfully created deployment %q", AppName)
+		podInfo = NewPodInfo(ds)
+		ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Normal", "CreatedDeployment", "Successfully created deployment %q (observed by operator pod %s/%s)", AppName, podInfo.Namespace, podInfo.Name)
+
+		if err = ingressRequest.waitForDeploymentReady(ctx, ds, podInfo); err != nil {
+			return fmt.Errorf("Failure waiting for %q Deployment to roll out for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+		}
+	}
+
+	if err = ingressRequest.CreateOrUpdateService(); err != nil {
+		return err
+	}
+
+	if err = ingressRequest.CreateOrUpdateConfigMap(backendProtocol); err != nil {
+		return err
 	}
 
+	metrics.ObserveDeploymentReplicas(desiredReplicas(ds), ds.Status.ReadyReplicas)
+
 	return nil
 }
 
+// desiredReplicas returns the Deployment's desired replica count, defaulting
+// to 1 to match the implicit default the Kubernetes API server applies when
+// Spec.Replicas is left nil.
+func desiredReplicas(ds *apps.Deployment) int32 {
+	if ds.Spec.Replicas == nil {
+		return 1
+	}
+	return *ds.Spec.Replicas
+}
+
 //GetDeploymentList lists DS in namespace with given selector
 func (ingressRequest *IngressRequest) GetDeploymentList(selector map[string]string) (*apps.DeploymentList, error) {
 	list := &apps.DeploymentList{
@@ -265,6 +422,10 @@ func (ingressRequest *IngressRequest) GetDeploymentList(selector map[string]stri
 	return list, err
 }
 
+// GetDeploymentPods lists the Pods matching selector, each carrying its
+// full container spec - including the grpc port newPodSpec adds for gRPC
+// backend protocols - for service discovery callers that need more than
+// the Service VIP, e.g. to target a specific pod directly.
 func (ingressRequest *IngressRequest) GetDeploymentPods(selector map[string]string) (*core.PodList, error) {
 	list := &core.PodList{
 		TypeMeta: metav1.TypeMeta{
@@ -299,33 +460,117 @@ func (ingressRequest *IngressRequest) RemoveDaemonset(name string) error {
 	klog.Infof("Deleting Deployment for %q.", ingressRequest.managementIngress.Name)
 	err := ingressRequest.Delete(deployment)
 	if err != nil && !errors.IsNotFound(err) {
+		metrics.EventTotal.WithLabelValues("delete", "failure").Inc()
 		return fmt.Errorf("Failure deleting %q deployment %v", name, err)
 	}
 
 	return nil
 }
 
-func (ingressRequest *IngressRequest) waitForDeploymentReady(ds *apps.Deployment) error {
+const (
+	defaultRolloutTimeout = 5 * time.Minute
+	rolloutBackoffInitial = 1 * time.Second
+	rolloutBackoffFactor  = 1.5
+	rolloutBackoffJitter  = 0.1
+	rolloutBackoffStepCap = 30 * time.Second
+)
 
-	err := wait.Poll(5*time.Second, 2*time.Second, func() (done bool, err error) {
-		err = ingressRequest.Get(ds.Name, ds)
-		if err != nil {
+// waitForDeploymentReady polls the Deployment with an exponential backoff
+// until the rollout has actually landed - the controller has observed the
+// latest generation and every replica has been updated to it and is ready -
+// or until Spec.RolloutTimeout elapses (5m by default) or ctx is cancelled.
+// A ProgressDeadlineExceeded condition ends the wait at once with an error. The
+// previous wait.Poll call used a 2s timeout against a 5s interval, so it
+// never actually polled, and judging readiness solely by
+// ReadyReplicas == Replicas was true even for a zero-replica or
+// stale-generation Deployment.
+//
+// podInfo.DeploymentUID pins the identity of the Deployment being waited on;
+// if it's deleted and recreated mid-poll, the name still resolves but it's a
+// different object whose rollout history doesn't match what the caller
+// started waiting for, so that's reported as a failure instead of being
+// silently polled as if nothing happened.
+func (ingressRequest *IngressRequest) waitForDeploymentReady(ctx context.Context, ds *apps.Deployment, podInfo *PodInfo) error {
+	rolloutTimeout := defaultRolloutTimeout
+	if rt := ingressRequest.managementIngress.Spec.RolloutTimeout; rt != nil {
+		rolloutTimeout = rt.Duration
+	}
+	deadline := time.Now().Add(rolloutTimeout)
+
+	backoff := wait.Backoff{
+		Duration: rolloutBackoffInitial,
+		Factor:   rolloutBackoffFactor,
+		Jitter:   rolloutBackoffJitter,
+		Cap:      rolloutBackoffStepCap,
+		Steps:    math.MaxInt32,
+	}
+
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, fmt.Errorf("rollout wait for deployment %q cancelled: %v", ds.Name, err)
+		}
+
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("timed out after %s waiting for deployment %q to roll out", rolloutTimeout, ds.Name)
+		}
+
+		if err := ingressRequest.Get(ds.Name, ds); err != nil {
 			if errors.IsNotFound(err) {
-				return false, fmt.Errorf("Failed to get Fluentd deployment: %v", err)
+				return false, fmt.Errorf("Failed to get %q deployment: %v", ds.Name, err)
 			}
 			return false, err
 		}
 
-		if int(ds.Status.ReadyReplicas) == int(ds.Status.Replicas) {
-			return true, nil
+		if podInfo != nil && podInfo.DeploymentUID != "" && ds.UID != podInfo.DeploymentUID {
+			return false, fmt.Errorf("deployment %q was deleted and recreated (UID changed from %s to %s) while waiting for rollout", ds.Name, podInfo.DeploymentUID, ds.UID)
+		}
+
+		for _, cond := range ds.Status.Conditions {
+			if cond.Type == apps.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+				return false, fmt.Errorf("deployment %q exceeded its progress deadline: %s", ds.Name, cond.Message)
+			}
+		}
+
+		if ds.Status.ObservedGeneration < ds.Generation {
+			return false, nil
+		}
+
+		// When an HPA manages this Deployment, Status.Replicas can keep
+		// climbing after we observe it, so waiting for an exact match would
+		// chase a moving target. Updated-and-ready-at-or-above the HPA's
+		// floor is enough; requiring UpdatedReplicas too keeps this from
+		// declaring victory on old-generation pods that are merely Ready.
+		if autoscalingSpec := ingressRequest.managementIngress.Spec.Autoscaling; autoscalingSpec != nil {
+			return ds.Status.UpdatedReplicas >= autoscalingSpec.MinReplicas && ds.Status.ReadyReplicas >= autoscalingSpec.MinReplicas, nil
 		}
 
-		return false, nil
+		desired := desiredReplicas(ds)
+		return ds.Status.UpdatedReplicas == desired && ds.Status.ReadyReplicas == desired, nil
 	})
 
 	if err != nil {
+		ingressRequest.recorder.Eventf(ingressRequest.managementIngress, "Warning", "RolloutStuck",
+			"Deployment %q did not become ready: %v (conditions: %s)", ds.Name, err, conditionMessages(ds))
 		return err
 	}
 
 	return nil
 }
+
+// conditionMessages renders a Deployment's status conditions into a single
+// string for inclusion in the RolloutStuck event, so operators don't have to
+// go spelunking in `kubectl describe` to see why a rollout stalled.
+func conditionMessages(ds *apps.Deployment) string {
+	if len(ds.Status.Conditions) == 0 {
+		return "none"
+	}
+
+	var b strings.Builder
+	for i, cond := range ds.Status.Conditions {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "%s=%s (%s): %s", cond.Type, cond.Status, cond.Reason, cond.Message)
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"fmt"
+	"reflect"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog"
+
+	"github.com/IBM/management-ingress-operator/pkg/utils"
+)
+
+// NewService stubs the Service fronting the management-ingress Deployment,
+// exposing the same https/http ports as the container plus, when
+// backendProtocol calls for it, the grpc listener newPodSpec added. When
+// authProxy is enabled, the https/http ports are redirected to the
+// oauth2-proxy sidecar's port instead of the main container's, so cluster
+// traffic can't bypass OIDC termination; the grpc listener is left pointing
+// at the main container, since oauth2-proxy only fronts HTTP(S).
+func NewService(name, namespace string, backendProtocol BackendProtocol, authProxy *AuthProxySpec) *core.Service {
+	labels := map[string]string{
+		"component": AppName,
+		"app":       AppName,
+	}
+
+	httpsTargetPort := intstr.FromInt(int(httpsPort))
+	httpTargetPort := intstr.FromInt(int(httpPort))
+	if authProxy != nil && authProxy.Enabled {
+		httpsTargetPort = intstr.FromInt(int(oauthProxyPort))
+		httpTargetPort = intstr.FromInt(int(oauthProxyPort))
+	}
+
+	ports := []core.ServicePort{
+		{Name: "https", Port: httpsPort, TargetPort: httpsTargetPort, Protocol: core.ProtocolTCP},
+		{Name: "http", Port: httpPort, TargetPort: httpTargetPort, Protocol: core.ProtocolTCP},
+	}
+	if isGRPCBackend(backendProtocol) {
+		ports = append(ports, core.ServicePort{Name: "grpc", Port: grpcPort, TargetPort: intstr.FromInt(int(grpcPort)), Protocol: core.ProtocolTCP})
+	}
+
+	return &core.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: core.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: core.ServiceSpec{
+			Selector: labels,
+			Ports:    ports,
+		},
+	}
+}
+
+// CreateOrUpdateService reconciles the Service fronting the Deployment,
+// keeping its ports in sync with whatever backend protocol newPodSpec built
+// the container for. It diffs against the current Spec first so a no-op
+// resync doesn't bump the Service's resourceVersion.
+func (ingressRequest *IngressRequest) CreateOrUpdateService() error {
+	backendProtocol := BackendProtocol(ingressRequest.managementIngress.Spec.BackendProtocol)
+	if backendProtocol == "" {
+		backendProtocol = BackendProtocolHTTP
+	}
+
+	svc := NewService(AppName, ingressRequest.managementIngress.Namespace, backendProtocol, ingressRequest.managementIngress.Spec.AuthProxy)
+	utils.AddOwnerRefToObject(svc, utils.AsOwner(ingressRequest.managementIngress))
+
+	klog.Infof("Creating or Updating Service: %s for %q.", AppName, ingressRequest.managementIngress.Name)
+	err := ingressRequest.Create(svc)
+	if err == nil {
+		return nil
+	}
+	if !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("Failure creating Service %q: %v", AppName, err)
+	}
+
+	current := &core.Service{}
+	if err := ingressRequest.Get(AppName, current); err != nil {
+		return fmt.Errorf("Failure getting Service %q for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+	}
+
+	svc.Spec.ClusterIP = current.Spec.ClusterIP
+	if reflect.DeepEqual(current.Spec, svc.Spec) {
+		return nil
+	}
+
+	svc.ResourceVersion = current.ResourceVersion
+	if err := ingressRequest.Update(svc); err != nil {
+		return fmt.Errorf("Failure updating Service %q for %q: %v", AppName, ingressRequest.managementIngress.Name, err)
+	}
+	return nil
+}